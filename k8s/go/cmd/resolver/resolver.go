@@ -15,28 +15,381 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
 	"path"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"os"
 
 	"github.com/bazelbuild/rules_docker/container/go/pkg/compat"
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
-	"gopkg.in/yaml.v2"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	legacyyaml "gopkg.in/yaml.v2"
+	k8syaml "sigs.k8s.io/yaml"
+	"golang.org/x/sync/errgroup"
 	lib "github.com/bazelbuild/rules_k8s/k8s/go/pkg/resolver"
 )
 
 var (
 	flags = lib.Flags{}
+
+	// legacyYAMLWalk preserves the old gopkg.in/yaml.v2, map[interface{}]interface{}
+	// based YAML walk, which resolves any string that happens to parse as an
+	// image tag. New callers should prefer the sigs.k8s.io/yaml based walk
+	// (the default), optionally narrowed with --image_field.
+	legacyYAMLWalk = flag.Bool("legacy_yaml_walk", false, "Use the legacy gopkg.in/yaml.v2 YAML walker and resolve any string that parses as an image tag, instead of the sigs.k8s.io/yaml walker. Provided for backward compatibility.")
+
+	// imageFields is the optional allowlist of JSONPath-style field paths
+	// (e.g. "spec.template.spec.containers[*].image") that restrict image
+	// resolution to fields Kubernetes actually treats as image references.
+	// It is only consulted when legacyYAMLWalk is false; an empty allowlist
+	// falls back to resolving any string that parses as an image tag.
+	imageFields repeatedStringFlag
+
+	// pushConcurrency bounds how many images are published to the remote
+	// registry at once. It defaults to the number of available CPUs, which is
+	// a reasonable stand-in for available upload bandwidth / parallelism.
+	pushConcurrency = flag.Int("push_concurrency", runtime.NumCPU(), "The maximum number of images to publish to the remote registry concurrently.")
+
+	// imageIndexSpecs collects repeated --image_index_spec flags, each
+	// describing one platform's image within a multi-arch manifest list.
+	imageIndexSpecs repeatedStringFlag
+
+	// registriesConfigFile points at a K3s-style registries.yaml configuring
+	// registry mirrors, TLS material, and basic-auth credentials.
+	registriesConfigFile = flag.String("registries_config", "", "Path to a K3s-style registries.yaml file configuring registry mirrors, TLS material, and basic-auth credentials for both pushing and resolving images.")
+
+	// registriesConfig is the parsed form of --registries_config, or nil if
+	// the flag wasn't set. It's read-only after main() loads it.
+	registriesConfig *RegistryConfig
+
+	// cosignKeyFile, cosignKMSURI and sbomFile opt in to a cosign-style
+	// signing and SBOM attachment stage after a successful push. Signing and
+	// SBOM attachment are independent and both optional: either, both or
+	// neither may be set.
+	cosignKeyFile = flag.String("cosign_key", "", "Path to a PEM-encoded ECDSA P-256 private key used to sign pushed images, cosign-style.")
+	cosignKMSURI  = flag.String("cosign_kms", "", "URI of a KMS-backed key (e.g. \"gcpkms://...\"). KMS-backed signing is not supported by this binary: if this flag is set, signing fails and the publish of every pushed image returns an error.")
+	sbomFile      = flag.String("sbom", "", "Path to an SPDX or CycloneDX SBOM document to attach to pushed images.")
+
+	// cosignSigner, cosignSignerErr and cosignSignerOnce cache the result of
+	// parsing --cosign_key, since publishSingle/buildAndPushIndex call
+	// loadCosignSigner once per pushed image.
+	cosignSigner     crypto.Signer
+	cosignSignerErr  error
+	cosignSignerOnce sync.Once
+)
+
+const (
+	// cosignSignatureType is the "type" field of the cosign simple-signing
+	// payload.
+	cosignSignatureType = "cosign container image signature"
+	// cosignSignatureAnnotation is the OCI annotation key cosign uses on a
+	// signature artifact's layer descriptor to carry the base64-encoded
+	// signature of the layer body.
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+	// cosignSignatureMediaType is the media type of a cosign simple-signing
+	// payload.
+	cosignSignatureMediaType types.MediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+)
+
+// registryPingTimeout bounds how long resolveMirror waits for a mirror
+// endpoint to answer its /v2/ ping before trying the next one.
+const registryPingTimeout = 5 * time.Second
+
+// RegistryConfig is the parsed form of a K3s-style registries.yaml file, e.g.:
+//
+//	mirrors:
+//	  docker.io:
+//	    endpoint: ["https://mirror.gcr.io", "https://registry-1.docker.io"]
+//	  "*":
+//	    endpoint: ["https://internal-mirror.example.com"]
+//	configs:
+//	  "internal-mirror.example.com":
+//	    auth:
+//	      username: user
+//	      password: pass
+//	    tls:
+//	      ca_file: /etc/certs/ca.pem
+type RegistryConfig struct {
+	// Mirrors maps a registry host (or "*" to match any host with no more
+	// specific entry) to the list of mirror endpoints that should be tried in
+	// order in its place.
+	Mirrors map[string]RegistryMirror `json:"mirrors"`
+	// Configs maps an endpoint host (as it appears in Mirrors, or a plain
+	// registry host) to the auth & TLS material to use when talking to it.
+	Configs map[string]RegistryEndpointConfig `json:"configs"`
+
+	// mirrorCacheMu guards mirrorCache. Unexported and unmarshaled as a
+	// zero-value sync.Mutex, which is ready to use.
+	mirrorCacheMu sync.Mutex
+	// mirrorCache memoizes resolveMirror's pings by host for the lifetime of
+	// this RegistryConfig (i.e. one run of the binary), since the same
+	// registry host is pinged once per image that shares it.
+	mirrorCache map[string]string
+}
+
+// RegistryMirror is the set of endpoints that may be substituted for a
+// registry host.
+type RegistryMirror struct {
+	Endpoint []string `json:"endpoint"`
+}
+
+// RegistryEndpointConfig carries the auth & TLS material to use when talking
+// to one registry endpoint.
+type RegistryEndpointConfig struct {
+	Auth *RegistryAuth `json:"auth,omitempty"`
+	TLS  *RegistryTLS  `json:"tls,omitempty"`
+}
+
+// RegistryAuth is a basic-auth credential pair for a registry endpoint.
+type RegistryAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// RegistryTLS is the TLS material to present and trust when talking to a
+// registry endpoint.
+type RegistryTLS struct {
+	CAFile             string `json:"ca_file,omitempty"`
+	CertFile           string `json:"cert_file,omitempty"`
+	KeyFile            string `json:"key_file,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+}
+
+// loadRegistryConfig reads and parses a K3s-style registries.yaml file.
+func loadRegistryConfig(file string) (*RegistryConfig, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read file: %v", err)
+	}
+	cfg := &RegistryConfig{}
+	if err := k8syaml.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("unmarshaling as YAML: %v", err)
+	}
+	return cfg, nil
+}
+
+// configFor returns the endpoint config for host, if any is configured. A nil
+// RegistryConfig has no configs for any host.
+func (c *RegistryConfig) configFor(host string) RegistryEndpointConfig {
+	if c == nil {
+		return RegistryEndpointConfig{}
+	}
+	return c.Configs[host]
+}
+
+// roundTripper builds the http.RoundTripper described by this endpoint
+// config's TLS material, or nil (meaning "use the default transport") if none
+// is configured.
+func (c RegistryEndpointConfig) roundTripper() (http.RoundTripper, error) {
+	if c.TLS == nil {
+		return nil, nil
+	}
+	tlsCfg := &tls.Config{InsecureSkipVerify: c.TLS.InsecureSkipVerify}
+	if c.TLS.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.TLS.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading ca_file %q: %v", c.TLS.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca_file %q", c.TLS.CAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if c.TLS.CertFile != "" || c.TLS.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading cert_file/key_file: %v", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Transport{TLSClientConfig: tlsCfg}, nil
+}
+
+// endpointHost returns the bare host[:port] of a mirror endpoint URL, since
+// name.Reference registries don't carry a scheme.
+func endpointHost(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("parsing endpoint %q: %v", endpoint, err)
+	}
+	if u.Host == "" {
+		return endpoint, nil
+	}
+	return u.Host, nil
+}
+
+// resolveMirror returns the host of the first endpoint configured for host
+// (falling back to the "*" wildcard entry) that answers a registry v2 ping,
+// or host itself if none are configured or none respond. A nil RegistryConfig
+// never rewrites a host. The result is memoized per host in mirrorCache, so
+// concurrent or repeated lookups for the same registry only ping it once per
+// run rather than once per image.
+func (c *RegistryConfig) resolveMirror(host string) string {
+	if c == nil {
+		return host
+	}
+	c.mirrorCacheMu.Lock()
+	defer c.mirrorCacheMu.Unlock()
+	if cached, ok := c.mirrorCache[host]; ok {
+		return cached
+	}
+
+	resolved := c.pingMirror(host)
+
+	if c.mirrorCache == nil {
+		c.mirrorCache = map[string]string{}
+	}
+	c.mirrorCache[host] = resolved
+	return resolved
+}
+
+// pingMirror does the actual work behind resolveMirror, which caches the
+// result since a registry ping is a synchronous network round trip.
+func (c *RegistryConfig) pingMirror(host string) string {
+	m, ok := c.Mirrors[host]
+	if !ok {
+		m, ok = c.Mirrors["*"]
+	}
+	if !ok || len(m.Endpoint) == 0 {
+		return host
+	}
+	for _, ep := range m.Endpoint {
+		epHost, err := endpointHost(ep)
+		if err != nil {
+			continue
+		}
+		rt, err := c.configFor(epHost).roundTripper()
+		if err != nil {
+			continue
+		}
+		client := &http.Client{Transport: rt, Timeout: registryPingTimeout}
+		resp, err := client.Get(strings.TrimRight(ep, "/") + "/v2/")
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusUnauthorized {
+			return epHost
+		}
+	}
+	return host
+}
+
+// rewriteRegistryHost rebuilds ref against the given registry host, keeping
+// its repository and tag or digest.
+func rewriteRegistryHost(ref name.Reference, host string) (name.Reference, error) {
+	repo := ref.Context().RepositoryStr()
+	switch r := ref.(type) {
+	case name.Tag:
+		return name.NewTag(fmt.Sprintf("%s/%s:%s", host, repo, r.TagStr()), name.WeakValidation)
+	case name.Digest:
+		return name.NewDigest(fmt.Sprintf("%s/%s@%s", host, repo, r.DigestStr()), name.WeakValidation)
+	default:
+		return nil, fmt.Errorf("unsupported reference type %T for %v", ref, ref)
+	}
+}
+
+// registryKeychain is an authn.Keychain that returns the basic-auth
+// credentials --registries_config configured for a matching host, falling
+// back to authn.DefaultKeychain for hosts with no configured auth.
+type registryKeychain struct {
+	cfg *RegistryConfig
+}
+
+// Resolve implements authn.Keychain.
+func (k registryKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	if auth := k.cfg.configFor(target.RegistryStr()).Auth; auth != nil {
+		return &authn.Basic{Username: auth.Username, Password: auth.Password}, nil
+	}
+	return authn.DefaultKeychain.Resolve(target)
+}
+
+// remoteOptionsFor rewrites ref's registry to its configured mirror (if any)
+// and returns the rewritten reference along with the remote.Options (auth,
+// and TLS transport if configured) to use when talking to it. With a nil
+// RegistryConfig, ref is returned unchanged with just authn.DefaultKeychain.
+func remoteOptionsFor(ref name.Reference) (name.Reference, []remote.Option, error) {
+	host := ref.Context().RegistryStr()
+	mirrorHost := registriesConfig.resolveMirror(host)
+	if mirrorHost != host {
+		rewritten, err := rewriteRegistryHost(ref, mirrorHost)
+		if err != nil {
+			return nil, nil, fmt.Errorf("rewriting %v to mirror %q: %v", ref, mirrorHost, err)
+		}
+		ref = rewritten
+	}
+	rt, err := registriesConfig.configFor(mirrorHost).roundTripper()
+	if err != nil {
+		return nil, nil, fmt.Errorf("building transport for %q: %v", mirrorHost, err)
+	}
+	auth, err := (registryKeychain{cfg: registriesConfig}).Resolve(ref.Context())
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to get authenticator for %v: %v", ref, err)
+	}
+	opts := []remote.Option{remote.WithAuth(auth)}
+	if rt != nil {
+		opts = append(opts, remote.WithTransport(rt))
+	}
+	return ref, opts, nil
+}
+
+const (
+	// pushRetries is the maximum number of attempts, the first one included,
+	// made for a single image push that keeps failing transiently.
+	pushRetries = 4
+	// pushRetryBaseDelay is the base delay used for the exponential backoff
+	// between push retries.
+	pushRetryBaseDelay = 500 * time.Millisecond
 )
 
+func init() {
+	flag.Var(&imageFields, "image_field", "A JSONPath-style field path (e.g. 'spec.template.spec.containers[*].image') identifying a field that should be treated as an image reference. May be repeated. If unset, any string that parses as an image tag is resolved.")
+	flag.Var(&imageIndexSpecs, "image_index_spec", "A platform entry for a multi-arch manifest list, in the same 'key1=val1;key2=val2' syntax as --image_spec plus a 'platform' key (e.g. 'linux/arm64'). Repeat once per platform; entries sharing the same 'name' are combined into one v1.ImageIndex.")
+}
+
+// repeatedStringFlag implements flag.Value, collecting every occurrence of a
+// repeatable flag into a slice of strings.
+type repeatedStringFlag []string
+
+func (f *repeatedStringFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *repeatedStringFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
 // imageSpec describes the differents parts of an image generated by
 // rules_docker.
 type imageSpec struct {
@@ -56,6 +409,10 @@ type imageSpec struct {
 	compressedLayers []string
 	// uncompressedLayers are the paths to the uncompressed layer tarballs.
 	uncomressedLayers []string
+	// platform is the "os/arch" this image was built for (e.g. "linux/arm64").
+	// It is only set for entries parsed from --image_index_spec, where it
+	// identifies this image's place in a multi-arch manifest list.
+	platform string
 }
 
 // layers returns a list of strings that can be passed to the image reader in
@@ -88,6 +445,8 @@ func (s *imageSpec) layers() ([]string, error) {
 // 5. "digest": Files with sha256 digest of compressed layers.
 // 6. "compressed_layer": Path to compressed layer tarballs.
 // 7. "uncompressed_layer": Path to uncompressed layer tarballs.
+// 8. "platform": The "os/arch" this image was built for, only meaningful for
+//    --image_index_spec entries (e.g. "linux/arm64").
 func parseImageSpec(spec string) (imageSpec, error) {
 	result := imageSpec{}
 	splitSpec := strings.Split(spec, ";")
@@ -111,6 +470,8 @@ func parseImageSpec(spec string) (imageSpec, error) {
 			result.compressedLayers = strings.Split(splitFields[1], ",")
 		case "uncompressed_layer":
 			result.uncomressedLayers = strings.Split(splitFields[1], ",")
+		case "platform":
+			result.platform = splitFields[1]
 		default:
 			return imageSpec{}, fmt.Errorf("unknown image spec field %q", splitFields[0])
 		}
@@ -118,6 +479,34 @@ func parseImageSpec(spec string) (imageSpec, error) {
 	return result, nil
 }
 
+// parseImageIndexSpecs groups per-platform --image_index_spec entries (each
+// parsed like --image_spec, plus a "platform" key) by their shared "name"
+// into the set of platform images that make up one multi-arch manifest list.
+func parseImageIndexSpecs(specs []string) (map[string][]imageSpec, error) {
+	result := map[string][]imageSpec{}
+	for _, s := range specs {
+		spec, err := parseImageSpec(s)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse image index spec %q: %v", s, err)
+		}
+		if spec.platform == "" {
+			return nil, fmt.Errorf("image index spec %q is missing a required 'platform' key", s)
+		}
+		result[spec.name] = append(result[spec.name], spec)
+	}
+	return result, nil
+}
+
+// splitPlatform splits a platform string in "os/arch" form (e.g.
+// "linux/arm64") into its OS and architecture.
+func splitPlatform(p string) (os, arch string, err error) {
+	parts := strings.SplitN(p, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("expected platform in the form \"os/arch\", got %q", p)
+	}
+	return parts[0], parts[1], nil
+}
+
 // parseSubsitutions parses a substitution file, which should be a JSON object
 // with strings to search for and values to replace them with. The replacement values
 // are stamped using the provided stamper.
@@ -141,78 +530,439 @@ func parseSubstitutions(file string, stamper *compat.Stamper) (map[string]string
 	return result.Substitutions, nil
 }
 
-// publishSingle publishes a docker image with the given spec to the remote
-// registry indicated in the image name. The image name is stamped with the
-// given stamper.
-// The stamped image name is returned referenced by its sha256 digest.
-func publishSingle(spec imageSpec, stamper *compat.Stamper) (string, error) {
+// readImage reads the image described by spec off disk, in the `docker save`
+// tarball format produced by rules_docker.
+func readImage(spec imageSpec) (v1.Image, error) {
 	layers, err := spec.layers()
 	if err != nil {
-		return "", fmt.Errorf("unable to convert the layer parts in image spec for %s into a single comma separated argument: %v", spec.name, err)
+		return nil, fmt.Errorf("unable to convert the layer parts in image spec for %s into a single comma separated argument: %v", spec.name, err)
 	}
 
 	imgParts, err := compat.ImagePartsFromArgs(spec.imgConfig, "", spec.imgTarball, layers)
 	if err != nil {
-		return "", fmt.Errorf("unable to determine parts of the image from the specified arguments: %v", err)
+		return nil, fmt.Errorf("unable to determine parts of the image from the specified arguments: %v", err)
 	}
 	img, err := compat.ReadImage(imgParts)
 	if err != nil {
-		return "", fmt.Errorf("error reading image: %v", err)
+		return nil, fmt.Errorf("error reading image: %v", err)
 	}
-	stampedName := stamper.Stamp(spec.name)
+	return img, nil
+}
 
-	var ref name.Reference
-	if flags.ImgChroot != "" {
-		n := path.Join(flags.ImgChroot, stampedName)
-		t, err := name.NewTag(n, name.WeakValidation)
+// imageRef resolves the given stamped image name into the reference it
+// should be pushed to, honoring --img_chroot. A stamped name that's already a
+// fully-qualified digest reference (e.g. "registry/repo@sha256:...") is never
+// chrooted, since prefixing its repo would invalidate the digest. A bare
+// digest reference with no registry component (e.g. "repo@sha256:...") is
+// still chrooted like a tag, since name.NewDigest would otherwise silently
+// default it to Docker Hub instead of the configured chroot.
+func imageRef(stampedName string) (name.Reference, error) {
+	if flags.ImgChroot == "" {
+		ref, err := name.ParseReference(stampedName, name.WeakValidation)
 		if err != nil {
-			return "", fmt.Errorf("unable to create a docker tag from stamped name %q: %v", n, err)
+			return nil, fmt.Errorf("unable to parse stamped name %q as an image reference: %v", stampedName, err)
 		}
-		ref = t
-	} else {
-		t, err := name.NewTag(stampedName, name.WeakValidation)
+		return ref, nil
+	}
+	if d, err := name.NewDigest(stampedName, name.StrictValidation); err == nil {
+		return d, nil
+	}
+	if _, err := name.NewDigest(stampedName, name.WeakValidation); err == nil {
+		// stampedName only parsed as a digest because NewDigest defaulted its
+		// missing registry component to Docker Hub. Chroot it like a tag,
+		// building the chrooted digest directly from the raw repo/digest
+		// substrings: going through the parsed name.Digest would reintroduce
+		// Docker Hub's implicit "library/" namespace, and name.NewTag below
+		// would reject the "@sha256:..." suffix as an invalid tag.
+		repo, digest, ok := strings.Cut(stampedName, "@")
+		if !ok {
+			return nil, fmt.Errorf("unable to split stamped name %q into repo and digest", stampedName)
+		}
+		n := path.Join(flags.ImgChroot, repo) + "@" + digest
+		chrooted, err := name.NewDigest(n, name.WeakValidation)
 		if err != nil {
-			return "", fmt.Errorf("unable to create a docker tag from stamped name %q: %v", stampedName, err)
+			return nil, fmt.Errorf("unable to create a chrooted digest from stamped name %q: %v", n, err)
 		}
-		ref = t
+		return chrooted, nil
 	}
-	auth, err := authn.DefaultKeychain.Resolve(ref.Context())
+	n := path.Join(flags.ImgChroot, stampedName)
+	t, err := name.NewTag(n, name.WeakValidation)
 	if err != nil {
-		return "", fmt.Errorf("unable to get authenticator for image %v", ref.Name())
+		return nil, fmt.Errorf("unable to create a docker tag from stamped name %q: %v", n, err)
 	}
+	return t, nil
+}
 
-	if !flags.NoPush {
-		if err := remote.Write(ref, img, remote.WithAuth(auth)); err != nil {
-			return "", fmt.Errorf("unable to push image %v: %v", ref.Name(), err)
+// cosignSimpleSigning is the signing payload format cosign signs, identifying
+// exactly which image digest a signature vouches for.
+type cosignSimpleSigning struct {
+	Critical cosignCritical `json:"critical"`
+}
+
+// cosignCritical is the part of a cosignSimpleSigning payload that's covered
+// by the signature.
+type cosignCritical struct {
+	Identity struct {
+		DockerReference string `json:"docker-reference"`
+	} `json:"identity"`
+	Image struct {
+		DockerManifestDigest string `json:"docker-manifest-digest"`
+	} `json:"image"`
+	Type string `json:"type"`
+}
+
+// loadCosignSigner returns the crypto.Signer configured by --cosign_key or
+// --cosign_kms. KMS-backed keys aren't implemented by this binary.
+func loadCosignSigner() (crypto.Signer, error) {
+	cosignSignerOnce.Do(func() {
+		cosignSigner, cosignSignerErr = parseCosignSigner()
+	})
+	return cosignSigner, cosignSignerErr
+}
+
+// parseCosignSigner does the actual work behind loadCosignSigner, which
+// caches the result since every image published with --cosign_key set would
+// otherwise re-read and re-parse the same key file from disk.
+func parseCosignSigner() (crypto.Signer, error) {
+	if *cosignKMSURI != "" {
+		return nil, fmt.Errorf("--cosign_kms=%q is not supported by this binary; sign with --cosign_key or an external cosign invocation", *cosignKMSURI)
+	}
+	pemBytes, err := ioutil.ReadFile(*cosignKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading --cosign_key %q: %v", *cosignKeyFile, err)
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("--cosign_key %q does not contain PEM-encoded data", *cosignKeyFile)
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("--cosign_key %q is neither an EC private key nor PKCS8: %v", *cosignKeyFile, err)
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("--cosign_key %q must be an ECDSA P-256 key, got %T", *cosignKeyFile, key)
+	}
+	return ecKey, nil
+}
+
+// signImageDigest signs ref's manifest digest, cosign-style, and returns the
+// simple-signing payload and its signature.
+func signImageDigest(ref name.Reference, d v1.Hash) (payload, sig []byte, err error) {
+	signer, err := loadCosignSigner()
+	if err != nil {
+		return nil, nil, err
+	}
+	var p cosignSimpleSigning
+	p.Critical.Identity.DockerReference = ref.Context().Name()
+	p.Critical.Image.DockerManifestDigest = d.String()
+	p.Critical.Type = cosignSignatureType
+	payload, err = json.Marshal(p)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshaling signing payload: %v", err)
+	}
+	sum := sha256.Sum256(payload)
+	sig, err = signer.Sign(rand.Reader, sum[:], crypto.SHA256)
+	if err != nil {
+		return nil, nil, fmt.Errorf("signing payload: %v", err)
+	}
+	return payload, sig, nil
+}
+
+// sbomMediaType guesses the media type of the SBOM at file from its name.
+func sbomMediaType(file string) types.MediaType {
+	lower := strings.ToLower(file)
+	if strings.Contains(lower, "cyclonedx") || strings.HasSuffix(lower, ".cdx.json") {
+		return "application/vnd.cyclonedx+json"
+	}
+	return "application/spdx+json"
+}
+
+// pushArtifact publishes a single-layer OCI artifact image whose layer body
+// is body, at the given tag alongside ref, reusing ref's push options.
+func pushArtifact(ref name.Reference, opts []remote.Option, tag string, body []byte, mediaType types.MediaType, annotations map[string]string) error {
+	img, err := mutate.Append(empty.Image, mutate.Addendum{
+		Layer:       static.NewLayer(body, mediaType),
+		Annotations: annotations,
+	})
+	if err != nil {
+		return fmt.Errorf("building artifact image: %v", err)
+	}
+	artifactRef, err := name.NewTag(fmt.Sprintf("%s/%s:%s", ref.Context().RegistryStr(), ref.Context().RepositoryStr(), tag), name.WeakValidation)
+	if err != nil {
+		return fmt.Errorf("building artifact reference: %v", err)
+	}
+	return pushWithRetry(artifactRef.Name(), func() error {
+		return remote.Write(artifactRef, img, opts...)
+	})
+}
+
+// signAndAttach implements an opt-in cosign-style signing and SBOM attachment
+// stage for the image just pushed to ref at digest d, built directly against
+// go-containerregistry primitives rather than shelling out to cosign. It's a
+// no-op unless --cosign_key, --cosign_kms, or --sbom is set.
+func signAndAttach(ref name.Reference, opts []remote.Option, d v1.Hash) error {
+	tag := func(suffix string) string {
+		return fmt.Sprintf("%s-%s.%s", d.Algorithm, d.Hex, suffix)
+	}
+
+	if *cosignKeyFile != "" || *cosignKMSURI != "" {
+		payload, sig, err := signImageDigest(ref, d)
+		if err != nil {
+			return fmt.Errorf("signing %v: %v", ref.Name(), err)
+		}
+		annotations := map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(sig)}
+		if err := pushArtifact(ref, opts, tag("sig"), payload, cosignSignatureMediaType, annotations); err != nil {
+			return fmt.Errorf("publishing signature for %v: %v", ref.Name(), err)
 		}
 	}
 
+	if *sbomFile != "" {
+		sbom, err := ioutil.ReadFile(*sbomFile)
+		if err != nil {
+			return fmt.Errorf("reading --sbom %q: %v", *sbomFile, err)
+		}
+		if err := pushArtifact(ref, opts, tag("sbom"), sbom, sbomMediaType(*sbomFile), nil); err != nil {
+			return fmt.Errorf("publishing SBOM for %v: %v", ref.Name(), err)
+		}
+	}
+	return nil
+}
+
+// publishSingle publishes a docker image with the given spec to the remote
+// registry indicated in the image name. The image name is stamped with the
+// given stamper. ctx is honored by the push itself (remote.WithContext), so
+// publish can cancel an in-flight push once another worker has failed.
+// The stamped image name is returned referenced by its sha256 digest.
+func publishSingle(ctx context.Context, spec imageSpec, stamper *compat.Stamper) (string, error) {
+	img, err := readImage(spec)
+	if err != nil {
+		return "", err
+	}
+	ref, err := imageRef(stamper.Stamp(spec.name))
+	if err != nil {
+		return "", err
+	}
+	ref, opts, err := remoteOptionsFor(ref)
+	if err != nil {
+		return "", err
+	}
+	opts = append(opts, remote.WithContext(ctx))
+
 	d, err := img.Digest()
 	if err != nil {
 		return "", fmt.Errorf("unable to get digest of image %v", ref.Name())
 	}
 
+	if !flags.NoPush {
+		if err := pushWithRetry(ref.Name(), func() error {
+			return remote.Write(ref, img, opts...)
+		}); err != nil {
+			return "", fmt.Errorf("unable to push image %v: %v", ref.Name(), err)
+		}
+		if err := signAndAttach(ref, opts, d); err != nil {
+			return "", err
+		}
+	}
+
 	return fmt.Sprintf("%s/%s@%v", ref.Context().RegistryStr(), ref.Context().RepositoryStr(), d), nil
 }
 
-// publish publishes the image with the given spec. It returns:
+// buildAndPushIndex builds a v1.ImageIndex (a multi-arch manifest list) from
+// the given per-platform image specs, which must all share the same name,
+// and pushes it to the remote registry. ctx is honored by the push itself
+// (remote.WithContext), so publish can cancel an in-flight push once another
+// worker has failed. The stamped index name is returned referenced by its
+// sha256 digest, in the same form publishSingle uses, so resolver can
+// rewrite Kubernetes manifests to it transparently.
+func buildAndPushIndex(ctx context.Context, indexName string, platforms []imageSpec, stamper *compat.Stamper) (string, error) {
+	var idx v1.ImageIndex = empty.Index
+	for _, p := range platforms {
+		img, err := readImage(p)
+		if err != nil {
+			return "", fmt.Errorf("unable to read platform %q of image index %q: %v", p.platform, indexName, err)
+		}
+		os, arch, err := splitPlatform(p.platform)
+		if err != nil {
+			return "", fmt.Errorf("image index %q: %v", indexName, err)
+		}
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{
+			Add: img,
+			Descriptor: v1.Descriptor{
+				Platform: &v1.Platform{OS: os, Architecture: arch},
+			},
+		})
+	}
+
+	ref, err := imageRef(stamper.Stamp(indexName))
+	if err != nil {
+		return "", err
+	}
+	ref, opts, err := remoteOptionsFor(ref)
+	if err != nil {
+		return "", err
+	}
+	opts = append(opts, remote.WithContext(ctx))
+
+	d, err := idx.Digest()
+	if err != nil {
+		return "", fmt.Errorf("unable to get digest of image index %v", ref.Name())
+	}
+
+	if !flags.NoPush {
+		if err := pushWithRetry(ref.Name(), func() error {
+			return remote.WriteIndex(ref, idx, opts...)
+		}); err != nil {
+			return "", fmt.Errorf("unable to push image index %v: %v", ref.Name(), err)
+		}
+		if err := signAndAttach(ref, opts, d); err != nil {
+			return "", err
+		}
+	}
+
+	return fmt.Sprintf("%s/%s@%v", ref.Context().RegistryStr(), ref.Context().RepositoryStr(), d), nil
+}
+
+// isTransientPushErr reports whether err is a registry error worth retrying,
+// i.e. a 5xx response or a connection dropped mid-transfer, as opposed to a
+// permanent failure like bad auth or a malformed image.
+func isTransientPushErr(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var terr *transport.Error
+	if errors.As(err, &terr) && terr.StatusCode >= 500 {
+		return true
+	}
+	return false
+}
+
+// pushWithRetry calls push, retrying transient registry errors (5xx
+// responses, dropped connections) with exponential backoff. This is common
+// enough on GCR/ECR under concurrent pushes that it's not worth failing the
+// whole run over. desc is only used to identify the push in log messages.
+func pushWithRetry(desc string, push func() error) error {
+	var err error
+	for attempt := 0; attempt < pushRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(pushRetryBaseDelay * time.Duration(1<<uint(attempt-1)))
+		}
+		if err = push(); err == nil {
+			return nil
+		}
+		if !isTransientPushErr(err) {
+			return err
+		}
+		log.Printf("transient error pushing %v (attempt %d/%d): %v", desc, attempt+1, pushRetries, err)
+	}
+	return err
+}
+
+// publish publishes the images with the given specs, and the multi-arch
+// manifest lists with the given per-platform specs grouped by index name,
+// fanning them all out across a bounded pool of --push_concurrency workers.
+// It returns:
 // 1. A map from the unstamped & tagged image name to the stamped image name
 //    referenced by its sha256 digest.
 // 2. A set of unstamped & tagged image names that were pushed to the registry.
-func publish(spec []imageSpec, stamper *compat.Stamper) (map[string]string, map[string]bool, error) {
+// The first error encountered cancels the remaining in-flight publishes.
+func publish(spec []imageSpec, indices map[string][]imageSpec, stamper *compat.Stamper) (map[string]string, map[string]bool, error) {
 	overrides := make(map[string]string)
 	unseen := make(map[string]bool)
+
+	var mu sync.Mutex
+	g, ctx := errgroup.WithContext(context.Background())
+	concurrency := *pushConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	g.SetLimit(concurrency)
+
 	for _, s := range spec {
-		digestRef, err := publishSingle(s, stamper)
-		if err != nil {
-			return nil, nil, err
-		}
-		overrides[s.name] = digestRef
-		unseen[s.name] = true
+		s := s
+		g.Go(func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			digestRef, err := publishSingle(ctx, s, stamper)
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			overrides[s.name] = digestRef
+			unseen[s.name] = true
+			mu.Unlock()
+			return nil
+		})
+	}
+	for indexName, platforms := range indices {
+		indexName, platforms := indexName, platforms
+		g.Go(func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			digestRef, err := buildAndPushIndex(ctx, indexName, platforms, stamper)
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			overrides[indexName] = digestRef
+			unseen[indexName] = true
+			mu.Unlock()
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, nil, err
 	}
 	return overrides, unseen, nil
 }
 
+// imageFieldPath compiles a JSONPath-style field path such as
+// "spec.template.spec.containers[*].image" into a sequence of path segments
+// that can be compared against the path tracked while walking a decoded YAML
+// document. A "[*]" suffix on a segment expands into the field name followed
+// by a wildcard segment that matches any list index.
+func imageFieldPath(pattern string) []string {
+	var out []string
+	for _, seg := range strings.Split(pattern, ".") {
+		if strings.HasSuffix(seg, "[*]") {
+			out = append(out, strings.TrimSuffix(seg, "[*]"), "*")
+			continue
+		}
+		out = append(out, seg)
+	}
+	return out
+}
+
+// matchesImageField reports whether path, the sequence of map keys and list
+// indices walked to reach a given string, matches one of the compiled
+// JSONPath-style field patterns.
+func matchesImageField(path []string, patterns [][]string) bool {
+	for _, p := range patterns {
+		if len(p) != len(path) {
+			continue
+		}
+		match := true
+		for i, seg := range p {
+			if seg == "*" {
+				continue
+			}
+			if seg != path[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
 // resolver implements walking over arbitrary k8s YAML templates and
 // transforming every string in the YAML with a configured string resolver.
 type resolver struct {
@@ -229,17 +979,22 @@ type resolver struct {
 	// numDocs stores the number of documents the resolver worked on when
 	// resolveYAML was called. This is used for testing only.
 	numDocs int
+	// imageFieldPatterns is the optional set of compiled JSONPath-style field
+	// paths that restrict strResolver to fields Kubernetes actually treats as
+	// image references. If empty, strResolver is invoked on every string,
+	// matching the legacy "resolve anything that looks like a tag" behavior.
+	imageFieldPatterns [][]string
 }
 
 // resolveString resolves a string found in the k8s YAML template by replacing
-// a tagged image name with an image name referenced by its sha256 digest. If
-// the given string doesn't represent a tagged image, it is returned as is.
-// The given resolver is also modified:
-// 1. If the given string was a tagged image, the resolved image lookup in the
-//    given resolver is updated to include a mapping from the given string to
-//    the resolved image name.
-// 2. If the given string was a tagged image, the set of unseen images in the
-//    given resolver is updated to exclude the given string.
+// a tagged or digest-pinned image name with an image name referenced by its
+// sha256 digest. If the given string doesn't represent an image reference, it
+// is returned as is. The given resolver is also modified:
+// 1. If the given string was an image reference, the resolved image lookup in
+//    the given resolver is updated to include a mapping from the given string
+//    to the resolved image name.
+// 2. If the given string was an image reference, the set of unseen images in
+//    the given resolver is updated to exclude the given string.
 // The resolver is best-effort, i.e., if any errors are encountered, the given
 // string is returned as is.
 func resolveString(r *resolver, s string) (string, error) {
@@ -250,43 +1005,71 @@ func resolveString(r *resolver, s string) (string, error) {
 	if ok {
 		return o, nil
 	}
-	t, err := name.NewTag(s, name.StrictValidation)
+	ref, err := name.ParseReference(s, name.StrictValidation)
 	if err != nil {
 		return s, nil
 	}
-	auth, err := authn.DefaultKeychain.Resolve(t.Context())
+	if mirrorHost := registriesConfig.resolveMirror(ref.Context().RegistryStr()); mirrorHost != ref.Context().RegistryStr() {
+		if rewritten, err := rewriteRegistryHost(ref, mirrorHost); err == nil {
+			ref = rewritten
+		}
+	}
+	if d, ok := ref.(name.Digest); ok {
+		// The template already pins this image by digest. Normalize it to
+		// "registry/repo@sha256:..." form so it matches the format used
+		// elsewhere, without making a registry round trip.
+		resolved := fmt.Sprintf("%s/%s@%s", d.Context().RegistryStr(), d.Context().RepositoryStr(), d.DigestStr())
+		r.resolvedImages[s] = resolved
+		return resolved, nil
+	}
+	rt, err := registriesConfig.configFor(ref.Context().RegistryStr()).roundTripper()
 	if err != nil {
 		return s, nil
 	}
-	desc, err := remote.Get(t, remote.WithAuth(auth))
+	auth, err := (registryKeychain{cfg: registriesConfig}).Resolve(ref.Context())
 	if err != nil {
 		return s, nil
 	}
-	resolved := fmt.Sprintf("%s/%s@%v", t.Context().RegistryStr(), t.Context().RepositoryStr(), desc.Digest)
+	opts := []remote.Option{remote.WithAuth(auth)}
+	if rt != nil {
+		opts = append(opts, remote.WithTransport(rt))
+	}
+	desc, err := remote.Get(ref, opts...)
+	if err != nil {
+		return s, nil
+	}
+	resolved := fmt.Sprintf("%s/%s@%v", ref.Context().RegistryStr(), ref.Context().RepositoryStr(), desc.Digest)
 	r.resolvedImages[s] = resolved
 	return resolved, nil
 }
 
 // resolveItem resolves the given YAML object if it's a string or recursively
-// walks into the YAML collection type.
-func (r *resolver) resolveItem(i interface{}) (interface{}, error) {
+// walks into the YAML collection type. path is the sequence of map keys and
+// list indices walked so far, used to honor imageFieldPatterns.
+func (r *resolver) resolveItem(path []string, i interface{}) (interface{}, error) {
 	if s, ok := i.(string); ok {
+		if len(r.imageFieldPatterns) > 0 && !matchesImageField(path, r.imageFieldPatterns) {
+			return s, nil
+		}
 		return r.strResolver(r, s)
 	}
 	if l, ok := i.([]interface{}); ok {
-		return r.resolveList(l)
+		return r.resolveList(path, l)
+	}
+	if m, ok := i.(map[string]interface{}); ok {
+		return r.resolveMap(path, m)
 	}
 	if m, ok := i.(map[interface{}]interface{}); ok {
-		return r.resolveMap(m)
+		return r.resolveLegacyMap(path, m)
 	}
 	return i, nil
 }
 
 // resolveList recursively walks the given yaml list.
-func (r *resolver) resolveList(l []interface{}) ([]interface{}, error) {
+func (r *resolver) resolveList(path []string, l []interface{}) ([]interface{}, error) {
 	result := []interface{}{}
-	for _, i := range l {
-		o, err := r.resolveItem(i)
+	for idx, i := range l {
+		o, err := r.resolveItem(append(append([]string{}, path...), strconv.Itoa(idx)), i)
 		if err != nil {
 			return nil, fmt.Errorf("error resolving item %v in list: %v", i, err)
 		}
@@ -295,15 +1078,35 @@ func (r *resolver) resolveList(l []interface{}) ([]interface{}, error) {
 	return result, nil
 }
 
-// resolveMap recursively walks the given yaml map.
-func (r *resolver) resolveMap(m map[interface{}]interface{}) (map[interface{}]interface{}, error) {
+// resolveMap recursively walks the given YAML map, as decoded by
+// sigs.k8s.io/yaml into JSON-compatible map[string]interface{} values.
+func (r *resolver) resolveMap(path []string, m map[string]interface{}) (map[string]interface{}, error) {
+	result := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		rv, err := r.resolveItem(append(append([]string{}, path...), k), v)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving value %v in map: %v", v, err)
+		}
+		result[k] = rv
+	}
+	return result, nil
+}
+
+// resolveLegacyMap recursively walks the given yaml map, as decoded by the
+// legacy gopkg.in/yaml.v2 walker. Map keys are resolved like any other value
+// for backward compatibility with the old behavior.
+func (r *resolver) resolveLegacyMap(path []string, m map[interface{}]interface{}) (map[interface{}]interface{}, error) {
 	result := make(map[interface{}]interface{})
 	for k, v := range m {
-		rk, err := r.resolveItem(k)
+		rk, err := r.resolveItem(path, k)
 		if err != nil {
 			return nil, fmt.Errorf("error resolving key %v in map: %v", k, err)
 		}
-		rv, err := r.resolveItem(v)
+		ks, ok := rk.(string)
+		if !ok {
+			ks = fmt.Sprintf("%v", rk)
+		}
+		rv, err := r.resolveItem(append(append([]string{}, path...), ks), v)
 		if err != nil {
 			return nil, fmt.Errorf("error resolving value %v in map: %v", v, err)
 		}
@@ -312,9 +1115,10 @@ func (r *resolver) resolveMap(m map[interface{}]interface{}) (map[interface{}]in
 	return result, nil
 }
 
-// yamlDoc implements the yaml.Unmarshaler interface that allows decoding an
-// arbitrary YAML document.
-type yamlDoc struct {
+// legacyYAMLDoc implements the yaml.Unmarshaler interface that allows
+// decoding an arbitrary YAML document using gopkg.in/yaml.v2. It backs the
+// --legacy_yaml_walk compatibility mode.
+type legacyYAMLDoc struct {
 	// vList stores an arbitrary YAML list.
 	vList []interface{}
 	// vMap stores an arbitrary YAML map.
@@ -335,7 +1139,7 @@ type yamlDoc struct {
 
 // UnmarshalYAML loads an arbitrary YAML document which can be a YAML list or
 // a YAML map into the given YAML document.
-func (y *yamlDoc) UnmarshalYAML(unmarshal func(interface{}) error) error {
+func (y *legacyYAMLDoc) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err := unmarshal(&y.vList); err == nil {
 		return nil
 	}
@@ -358,7 +1162,7 @@ func (y *yamlDoc) UnmarshalYAML(unmarshal func(interface{}) error) error {
 }
 
 // val gets the stored YAML value in this document.
-func (y *yamlDoc) val() interface{} {
+func (y *legacyYAMLDoc) val() interface{} {
 	if y.vList != nil {
 		return y.vList
 	}
@@ -377,21 +1181,22 @@ func (y *yamlDoc) val() interface{} {
 	return nil
 }
 
-// resolveYAML recursively walks the given stream of arbitrary YAML documents
-// and calls the strResolver on each string in the YAML document.
-func (r *resolver) resolveYAML(t io.Reader) ([]byte, error) {
-	d := yaml.NewDecoder(t)
+// resolveYAMLLegacy recursively walks the given stream of arbitrary YAML
+// documents using gopkg.in/yaml.v2 and calls the strResolver on each string
+// in the YAML document. It backs the --legacy_yaml_walk compatibility mode.
+func (r *resolver) resolveYAMLLegacy(t io.Reader) ([]byte, error) {
+	d := legacyyaml.NewDecoder(t)
 	buf := bytes.NewBuffer(nil)
-	e := yaml.NewEncoder(buf)
+	e := legacyyaml.NewEncoder(buf)
 	defer e.Close()
 	for {
-		y := yamlDoc{}
+		y := legacyYAMLDoc{}
 		err := d.Decode(&y)
 		if err != nil && err != io.EOF {
 			return nil, err
 		}
 		done := err == io.EOF
-		o, err := r.resolveItem(y.val())
+		o, err := r.resolveItem(nil, y.val())
 		if err != nil {
 			return nil, fmt.Errorf("error resolving YAML template: %v", err)
 		}
@@ -410,6 +1215,76 @@ func (r *resolver) resolveYAML(t io.Reader) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// yamlDocSeparator splits a stream of YAML documents on lines consisting of
+// only the "---" document separator, the same boundary sigs.k8s.io/yaml
+// expects to be handled by the caller since it only converts a single
+// document at a time.
+var yamlDocSeparator = regexp.MustCompile(`(?m)^---[ \t]*$\r?\n?`)
+
+// splitYAMLDocuments splits a multi-document YAML stream into its individual
+// documents.
+func splitYAMLDocuments(t []byte) [][]byte {
+	var docs [][]byte
+	for _, d := range yamlDocSeparator.Split(string(t), -1) {
+		if strings.TrimSpace(d) == "" {
+			continue
+		}
+		docs = append(docs, []byte(d))
+	}
+	return docs
+}
+
+// useJSONNumber is a sigs.k8s.io/yaml JSONOpt that decodes YAML/JSON numbers
+// into json.Number instead of float64, as the package's own docs recommend,
+// so that integers outside float64's 2^53 exact-integer range (e.g. a large
+// generation or resourceVersion) round-trip through resolveYAML without
+// precision loss. json.Number falls through resolveItem's string/list/map
+// type switch untouched, and k8syaml.Marshal re-emits it as the original
+// numeric literal.
+func useJSONNumber(d *json.Decoder) *json.Decoder {
+	d.UseNumber()
+	return d
+}
+
+// resolveYAML recursively walks the given stream of arbitrary YAML documents
+// and calls the strResolver on each string in the YAML document. Each
+// document is converted to JSON and decoded into map[string]interface{} /
+// []interface{} via sigs.k8s.io/yaml, so that scalar types and nested
+// structure match how kubectl and the Kubernetes API see the manifest,
+// rather than the looser typing gopkg.in/yaml.v2 applies when decoding into
+// map[interface{}]interface{}.
+func (r *resolver) resolveYAML(t io.Reader) ([]byte, error) {
+	b, err := ioutil.ReadAll(t)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(nil)
+	for _, doc := range splitYAMLDocuments(b) {
+		var v interface{}
+		if err := k8syaml.Unmarshal(doc, &v, useJSONNumber); err != nil {
+			return nil, fmt.Errorf("error unmarshaling YAML document: %v", err)
+		}
+		o, err := r.resolveItem(nil, v)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving YAML template: %v", err)
+		}
+		if o == nil {
+			continue
+		}
+		r.numDocs++
+		out, err := k8syaml.Marshal(o)
+		if err != nil {
+			return nil, err
+		}
+		if buf.Len() > 0 {
+			buf.WriteString("---\n")
+		}
+		buf.Write(out)
+	}
+
+	return buf.Bytes(), nil
+}
+
 // resolveTemplate resolves the given YAML template using the given mapping from
 // tagged to fully qualified image names referenced by their digest and the
 // set of image names that haven't been seen yet. The given set of unseen images
@@ -425,13 +1300,26 @@ func resolveTemplate(templateFile string, resolvedImages map[string]string, unse
 		t = bytes.ReplaceAll(t, []byte(k), []byte(v))
 	}
 
+	var patterns [][]string
+	if !*legacyYAMLWalk {
+		for _, f := range imageFields {
+			patterns = append(patterns, imageFieldPath(f))
+		}
+	}
+
 	r := resolver{
-		resolvedImages: resolvedImages,
-		unseen:         unseen,
-		strResolver:    resolveString,
+		resolvedImages:     resolvedImages,
+		unseen:             unseen,
+		strResolver:        resolveString,
+		imageFieldPatterns: patterns,
 	}
 
-	resolved, err := r.resolveYAML(bytes.NewReader(t))
+	var resolved []byte
+	if *legacyYAMLWalk {
+		resolved, err = r.resolveYAMLLegacy(bytes.NewReader(t))
+	} else {
+		resolved, err = r.resolveYAML(bytes.NewReader(t))
+	}
 	if err != nil {
 		return fmt.Errorf("unable to resolve YAML template %q: %v", templateFile, err)
 	}
@@ -444,6 +1332,14 @@ func main() {
 	lib.RegisterFlags(flagset)
 	flagset.Parse(os.Args[1:])
 
+	if *registriesConfigFile != "" {
+		cfg, err := loadRegistryConfig(*registriesConfigFile)
+		if err != nil {
+			log.Fatalf("Unable to load --registries_config %q: %v", *registriesConfigFile, err)
+		}
+		registriesConfig = cfg
+	}
+
 	stamper, err := compat.NewStamper(flags.StampInfoFile)
 	if err != nil {
 		log.Fatalf("Failed to initialize the stamper: %v", err)
@@ -458,6 +1354,11 @@ func main() {
 		specs = append(specs, spec)
 	}
 
+	indices, err := parseImageIndexSpecs(imageIndexSpecs)
+	if err != nil {
+		log.Fatalf("Unable to parse image index specs: %v", err)
+	}
+
 	substitutions := map[string]string{}
 	if flags.SubstitutionsFile != "" {
 		substitutions, err = parseSubstitutions(flags.SubstitutionsFile, stamper)
@@ -466,7 +1367,7 @@ func main() {
 		}
 	}
 
-	resolvedImages, unseen, err := publish(specs, stamper)
+	resolvedImages, unseen, err := publish(specs, indices, stamper)
 	if err != nil {
 		log.Fatalf("Unable to publish images: %v", err)
 	}
@@ -0,0 +1,415 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func TestImageFieldPath(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    []string
+	}{{
+		pattern: "spec.template.spec.containers[*].image",
+		want:    []string{"spec", "template", "spec", "containers", "*", "image"},
+	}, {
+		pattern: "image",
+		want:    []string{"image"},
+	}, {
+		pattern: "spec.initContainers[*].image",
+		want:    []string{"spec", "initContainers", "*", "image"},
+	}}
+	for _, tc := range tests {
+		if got := imageFieldPath(tc.pattern); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("imageFieldPath(%q) = %v, want %v", tc.pattern, got, tc.want)
+		}
+	}
+}
+
+func TestImageRef(t *testing.T) {
+	const digestHex = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	tests := []struct {
+		name        string
+		imgChroot   string
+		stampedName string
+		want        string
+	}{{
+		name:        "no chroot, tag",
+		stampedName: "gcr.io/foo/bar:latest",
+		want:        "gcr.io/foo/bar:latest",
+	}, {
+		name:        "no chroot, digest",
+		stampedName: "gcr.io/foo/bar@sha256:" + digestHex,
+		want:        "gcr.io/foo/bar@sha256:" + digestHex,
+	}, {
+		name:        "chroot, tag",
+		imgChroot:   "internal-registry.example.com/prefix",
+		stampedName: "bar:latest",
+		want:        "internal-registry.example.com/prefix/bar:latest",
+	}, {
+		name:        "chroot, fully-qualified digest is left alone",
+		imgChroot:   "internal-registry.example.com/prefix",
+		stampedName: "gcr.io/foo/bar@sha256:" + digestHex,
+		want:        "gcr.io/foo/bar@sha256:" + digestHex,
+	}, {
+		name:        "chroot, bare digest is chrooted like a tag",
+		imgChroot:   "internal-registry.example.com/prefix",
+		stampedName: "bar@sha256:" + digestHex,
+		want:        "internal-registry.example.com/prefix/bar@sha256:" + digestHex,
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			old := flags.ImgChroot
+			flags.ImgChroot = tc.imgChroot
+			defer func() { flags.ImgChroot = old }()
+
+			ref, err := imageRef(tc.stampedName)
+			if err != nil {
+				t.Fatalf("imageRef(%q) returned unexpected error: %v", tc.stampedName, err)
+			}
+			if got := ref.Name(); got != tc.want {
+				t.Errorf("imageRef(%q) = %q, want %q", tc.stampedName, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResolveMirror(t *testing.T) {
+	pings := 0
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pings++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer mirror.Close()
+	mirrorHost, err := url.Parse(mirror.URL)
+	if err != nil {
+		t.Fatalf("parsing test server URL %q: %v", mirror.URL, err)
+	}
+
+	cfg := &RegistryConfig{
+		Mirrors: map[string]RegistryMirror{
+			"gcr.io": {Endpoint: []string{mirror.URL}},
+		},
+	}
+
+	if got := cfg.resolveMirror("gcr.io"); got != mirrorHost.Host {
+		t.Errorf("resolveMirror(gcr.io) = %q, want %q", got, mirrorHost.Host)
+	}
+	if got := cfg.resolveMirror("gcr.io"); got != mirrorHost.Host {
+		t.Errorf("second resolveMirror(gcr.io) = %q, want %q", got, mirrorHost.Host)
+	}
+	if pings != 1 {
+		t.Errorf("mirror endpoint was pinged %d times, want 1 (result should be cached)", pings)
+	}
+	if got := cfg.resolveMirror("docker.io"); got != "docker.io" {
+		t.Errorf("resolveMirror(docker.io) = %q, want docker.io unchanged (no mirror configured)", got)
+	}
+}
+
+func TestResolveMirrorNilConfig(t *testing.T) {
+	var cfg *RegistryConfig
+	if got := cfg.resolveMirror("gcr.io"); got != "gcr.io" {
+		t.Errorf("nil RegistryConfig.resolveMirror(gcr.io) = %q, want gcr.io unchanged", got)
+	}
+}
+
+func TestRewriteRegistryHost(t *testing.T) {
+	tag, err := name.NewTag("gcr.io/foo/bar:latest", name.WeakValidation)
+	if err != nil {
+		t.Fatalf("building test tag: %v", err)
+	}
+	rewritten, err := rewriteRegistryHost(tag, "mirror.example.com")
+	if err != nil {
+		t.Fatalf("rewriteRegistryHost(%v, mirror.example.com) returned unexpected error: %v", tag, err)
+	}
+	if got, want := rewritten.Name(), "mirror.example.com/foo/bar:latest"; got != want {
+		t.Errorf("rewriteRegistryHost(%v, mirror.example.com) = %q, want %q", tag, got, want)
+	}
+
+	const digestHex = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	digest, err := name.NewDigest("gcr.io/foo/bar@sha256:"+digestHex, name.WeakValidation)
+	if err != nil {
+		t.Fatalf("building test digest: %v", err)
+	}
+	rewritten, err = rewriteRegistryHost(digest, "mirror.example.com")
+	if err != nil {
+		t.Fatalf("rewriteRegistryHost(%v, mirror.example.com) returned unexpected error: %v", digest, err)
+	}
+	if got, want := rewritten.Name(), "mirror.example.com/foo/bar@sha256:"+digestHex; got != want {
+		t.Errorf("rewriteRegistryHost(%v, mirror.example.com) = %q, want %q", digest, got, want)
+	}
+}
+
+func TestRegistryKeychainConfiguredAuth(t *testing.T) {
+	cfg := &RegistryConfig{
+		Configs: map[string]RegistryEndpointConfig{
+			"mirror.example.com": {Auth: &RegistryAuth{Username: "user", Password: "pass"}},
+		},
+	}
+	repo, err := name.NewRepository("mirror.example.com/foo/bar")
+	if err != nil {
+		t.Fatalf("building test repository: %v", err)
+	}
+	auth, err := (registryKeychain{cfg: cfg}).Resolve(repo)
+	if err != nil {
+		t.Fatalf("registryKeychain.Resolve(%v) returned unexpected error: %v", repo, err)
+	}
+	cfgAuth, err := auth.Authorization()
+	if err != nil {
+		t.Fatalf("auth.Authorization() returned unexpected error: %v", err)
+	}
+	want := &authn.AuthConfig{Username: "user", Password: "pass"}
+	if !reflect.DeepEqual(cfgAuth, want) {
+		t.Errorf("registryKeychain.Resolve(%v) authorization = %+v, want %+v", repo, cfgAuth, want)
+	}
+}
+
+func TestSplitPlatform(t *testing.T) {
+	tests := []struct {
+		platform string
+		wantOS   string
+		wantArch string
+		wantErr  bool
+	}{{
+		platform: "linux/arm64",
+		wantOS:   "linux",
+		wantArch: "arm64",
+	}, {
+		platform: "linux/amd64",
+		wantOS:   "linux",
+		wantArch: "amd64",
+	}, {
+		platform: "linux",
+		wantErr:  true,
+	}, {
+		platform: "/arm64",
+		wantErr:  true,
+	}, {
+		platform: "linux/",
+		wantErr:  true,
+	}}
+	for _, tc := range tests {
+		gotOS, gotArch, err := splitPlatform(tc.platform)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("splitPlatform(%q) = %q, %q, nil, want error", tc.platform, gotOS, gotArch)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("splitPlatform(%q) returned unexpected error: %v", tc.platform, err)
+			continue
+		}
+		if gotOS != tc.wantOS || gotArch != tc.wantArch {
+			t.Errorf("splitPlatform(%q) = %q, %q, want %q, %q", tc.platform, gotOS, gotArch, tc.wantOS, tc.wantArch)
+		}
+	}
+}
+
+func TestParseImageIndexSpecs(t *testing.T) {
+	specs := []string{
+		"name=gcr.io/foo/bar:latest;tarball=arm64.tar;config=arm64.json;platform=linux/arm64",
+		"name=gcr.io/foo/bar:latest;tarball=amd64.tar;config=amd64.json;platform=linux/amd64",
+		"name=gcr.io/foo/baz:latest;tarball=baz.tar;config=baz.json;platform=linux/amd64",
+	}
+	got, err := parseImageIndexSpecs(specs)
+	if err != nil {
+		t.Fatalf("parseImageIndexSpecs(%v) returned unexpected error: %v", specs, err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("parseImageIndexSpecs(%v) returned %d names, want 2", specs, len(got))
+	}
+	bar := got["gcr.io/foo/bar:latest"]
+	if len(bar) != 2 {
+		t.Fatalf("got %d platform images for gcr.io/foo/bar:latest, want 2", len(bar))
+	}
+	if bar[0].platform != "linux/arm64" || bar[1].platform != "linux/amd64" {
+		t.Errorf("gcr.io/foo/bar:latest platforms = %q, %q, want linux/arm64, linux/amd64", bar[0].platform, bar[1].platform)
+	}
+	baz := got["gcr.io/foo/baz:latest"]
+	if len(baz) != 1 || baz[0].platform != "linux/amd64" {
+		t.Errorf("gcr.io/foo/baz:latest = %+v, want a single linux/amd64 entry", baz)
+	}
+}
+
+func TestParseImageIndexSpecsMissingPlatform(t *testing.T) {
+	specs := []string{"name=gcr.io/foo/bar:latest;tarball=arm64.tar;config=arm64.json"}
+	if _, err := parseImageIndexSpecs(specs); err == nil {
+		t.Errorf("parseImageIndexSpecs(%v) succeeded, want an error for the missing platform key", specs)
+	}
+}
+
+func TestMatchesImageField(t *testing.T) {
+	patterns := [][]string{
+		imageFieldPath("spec.template.spec.containers[*].image"),
+		imageFieldPath("spec.initContainers[*].image"),
+	}
+	tests := []struct {
+		name string
+		path []string
+		want bool
+	}{{
+		name: "matches containers wildcard",
+		path: []string{"spec", "template", "spec", "containers", "0", "image"},
+		want: true,
+	}, {
+		name: "matches initContainers wildcard",
+		path: []string{"spec", "initContainers", "3", "image"},
+		want: true,
+	}, {
+		name: "wrong field name at leaf",
+		path: []string{"spec", "template", "spec", "containers", "0", "name"},
+		want: false,
+	}, {
+		name: "wrong length",
+		path: []string{"spec", "containers", "0", "image"},
+		want: false,
+	}, {
+		name: "unrelated field",
+		path: []string{"metadata", "name"},
+		want: false,
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := matchesImageField(tc.path, patterns); got != tc.want {
+				t.Errorf("matchesImageField(%v, patterns) = %v, want %v", tc.path, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSbomMediaType(t *testing.T) {
+	tests := []struct {
+		file string
+		want types.MediaType
+	}{{
+		file: "image.spdx.json",
+		want: "application/spdx+json",
+	}, {
+		file: "image.cdx.json",
+		want: "application/vnd.cyclonedx+json",
+	}, {
+		file: "cyclonedx-sbom.json",
+		want: "application/vnd.cyclonedx+json",
+	}, {
+		file: "IMAGE.CDX.JSON",
+		want: "application/vnd.cyclonedx+json",
+	}, {
+		file: "sbom.json",
+		want: "application/spdx+json",
+	}}
+	for _, tc := range tests {
+		if got := sbomMediaType(tc.file); got != tc.want {
+			t.Errorf("sbomMediaType(%q) = %q, want %q", tc.file, got, tc.want)
+		}
+	}
+}
+
+func TestIsTransientPushErr(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{{
+		name: "EOF",
+		err:  io.EOF,
+		want: true,
+	}, {
+		name: "unexpected EOF",
+		err:  io.ErrUnexpectedEOF,
+		want: true,
+	}, {
+		name: "wrapped EOF",
+		err:  fmt.Errorf("writing layer: %w", io.EOF),
+		want: true,
+	}, {
+		name: "5xx transport error",
+		err:  &transport.Error{StatusCode: http.StatusServiceUnavailable},
+		want: true,
+	}, {
+		name: "4xx transport error",
+		err:  &transport.Error{StatusCode: http.StatusUnauthorized},
+		want: false,
+	}, {
+		name: "unrelated error",
+		err:  errors.New("bad image config"),
+		want: false,
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isTransientPushErr(tc.err); got != tc.want {
+				t.Errorf("isTransientPushErr(%v) = %v, want %v", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPushWithRetrySucceedsAfterTransientErrors(t *testing.T) {
+	attempts := 0
+	err := pushWithRetry("test-image", func() error {
+		attempts++
+		if attempts < pushRetries {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("pushWithRetry returned unexpected error: %v", err)
+	}
+	if attempts != pushRetries {
+		t.Errorf("push was attempted %d times, want %d", attempts, pushRetries)
+	}
+}
+
+func TestPushWithRetryGivesUpOnPermanentError(t *testing.T) {
+	permanent := errors.New("bad auth")
+	attempts := 0
+	err := pushWithRetry("test-image", func() error {
+		attempts++
+		return permanent
+	})
+	if !errors.Is(err, permanent) {
+		t.Errorf("pushWithRetry returned %v, want %v", err, permanent)
+	}
+	if attempts != 1 {
+		t.Errorf("push was attempted %d times, want 1 (no retries for a permanent error)", attempts)
+	}
+}
+
+func TestPushWithRetryExhaustsRetries(t *testing.T) {
+	attempts := 0
+	err := pushWithRetry("test-image", func() error {
+		attempts++
+		return io.ErrUnexpectedEOF
+	})
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("pushWithRetry returned %v, want io.ErrUnexpectedEOF", err)
+	}
+	if attempts != pushRetries {
+		t.Errorf("push was attempted %d times, want %d", attempts, pushRetries)
+	}
+}